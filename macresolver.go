@@ -0,0 +1,261 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultMACAssignmentsFile is where the "file" MACResolver looks for a
+// containerID/network -> MAC mapping when NetConf doesn't override it.
+const defaultMACAssignmentsFile = "/etc/cni/mac-assignments.json"
+
+// defaultRancherMetadataURL is where the rancher-metadata resolver looks
+// up a container's primary MAC address.
+const defaultRancherMetadataURL = "http://rancher-metadata/2016-07-29"
+
+// httpClientTimeout bounds how long a MACResolver will wait on an HTTP
+// call (rancher-metadata or a "http" macSource), so a slow or
+// unresponsive server can't hang cmdAdd indefinitely.
+const httpClientTimeout = 10 * time.Second
+
+// MACResolver resolves the MAC address a container's macvlan interface
+// should get. NetConf's "macSource" field selects an implementation, so
+// this plugin can be used outside a Rancher environment while keeping
+// the rancher-metadata lookup as the default.
+type MACResolver interface {
+	ResolveMAC(containerID, network, rancherUUID string) (string, error)
+}
+
+// macResolverFromConfig builds the MACResolver n.MACSource asks for.
+func macResolverFromConfig(n *NetConf) (MACResolver, error) {
+	switch n.MACSource {
+	case "", "rancher-metadata":
+		return rancherMetadataResolver{}, nil
+	case "file":
+		path := n.MACSourceFile
+		if path == "" {
+			path = defaultMACAssignmentsFile
+		}
+		return fileMACResolver{path: path}, nil
+	case "http":
+		if n.MACSourceURL == "" {
+			return nil, errors.New(`"macSourceURL" is required when macSource is "http"`)
+		}
+		return httpMACResolver{url: n.MACSourceURL}, nil
+	case "static-pool":
+		if len(n.MACPool) == 0 {
+			return nil, errors.New(`"macPool" is required when macSource is "static-pool"`)
+		}
+		return staticPoolMACResolver{pool: n.MACPool}, nil
+	case "hash":
+		return hashMACResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown macSource: %q", n.MACSource)
+	}
+}
+
+// rancherMetadataResolver preserves this plugin's original behavior:
+// looking the MAC up from Rancher's metadata via the container's UUID.
+type rancherMetadataResolver struct{}
+
+func (rancherMetadataResolver) ResolveMAC(containerID, network, rancherUUID string) (string, error) {
+	return findMACAddressForContainer(containerID, rancherUUID)
+}
+
+// rancherMetadataContainer is the subset of Rancher metadata's /containers
+// response this plugin needs.
+type rancherMetadataContainer struct {
+	UUID              string `json:"uuid"`
+	ExternalId        string `json:"external_id"`
+	PrimaryMacAddress string `json:"primary_mac_address"`
+}
+
+// rancherMetadataClient bounds how long findMACAddressForContainer will
+// wait on rancher-metadata, so an unresponsive metadata service can't hang
+// cmdAdd (and therefore container creation) indefinitely.
+var rancherMetadataClient = &http.Client{Timeout: httpClientTimeout}
+
+// findMACAddressForContainer looks up containerID's primary MAC address
+// from Rancher's metadata service, preferring a match on rancherUUID (the
+// CNI_ARGS RancherContainerUUID the container runtime supplies) and
+// falling back to the CNI containerID against the metadata service's
+// external_id.
+func findMACAddressForContainer(containerID, rancherUUID string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, defaultRancherMetadataURL+"/containers", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := rancherMetadataClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach rancher-metadata: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("rancher-metadata returned status %v", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read rancher-metadata response: %v", err)
+	}
+
+	var containers []rancherMetadataContainer
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return "", fmt.Errorf("failed to parse rancher-metadata response: %v", err)
+	}
+
+	var match *rancherMetadataContainer
+	for i := range containers {
+		if rancherUUID != "" && containers[i].UUID == rancherUUID {
+			match = &containers[i]
+			break
+		}
+		if match == nil && containers[i].ExternalId == containerID {
+			match = &containers[i]
+		}
+	}
+	if match != nil {
+		if match.PrimaryMacAddress == "" {
+			return "", fmt.Errorf("rancher-metadata has no primary MAC address for container %v", containerID)
+		}
+		return match.PrimaryMacAddress, nil
+	}
+	return "", fmt.Errorf("no rancher-metadata container found for %v (uuid %v)", containerID, rancherUUID)
+}
+
+// fileMACResolver reads a static containerID/network -> MAC mapping from
+// a JSON file, keyed as "<containerID>/<network>".
+type fileMACResolver struct {
+	path string
+}
+
+func (r fileMACResolver) ResolveMAC(containerID, network, rancherUUID string) (string, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read MAC assignments file %q: %v", r.path, err)
+	}
+
+	assignments := map[string]string{}
+	if err := json.Unmarshal(data, &assignments); err != nil {
+		return "", fmt.Errorf("failed to parse MAC assignments file %q: %v", r.path, err)
+	}
+
+	key := containerID + "/" + network
+	mac, ok := assignments[key]
+	if !ok {
+		return "", fmt.Errorf("no MAC assignment for %q in %q", key, r.path)
+	}
+	return mac, nil
+}
+
+// httpMACResolver asks a user-configured URL for the MAC to use,
+// passing the container ID and network as query parameters.
+type httpMACResolver struct {
+	url string
+}
+
+type httpMACResolverResponse struct {
+	MAC string `json:"mac"`
+}
+
+// httpResolverClient bounds how long an httpMACResolver will wait on
+// macSourceURL, so a slow or unresponsive server can't hang cmdAdd (and
+// therefore container creation) indefinitely.
+var httpResolverClient = &http.Client{Timeout: httpClientTimeout}
+
+func (r httpMACResolver) ResolveMAC(containerID, network, rancherUUID string) (string, error) {
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return "", fmt.Errorf("invalid macSourceURL %q: %v", r.url, err)
+	}
+	q := u.Query()
+	q.Set("containerId", containerID)
+	q.Set("network", network)
+	u.RawQuery = q.Encode()
+
+	resp, err := httpResolverClient.Get(u.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch MAC from %q: %v", u.String(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("MAC resolver at %q returned status %v", u.String(), resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from %q: %v", u.String(), err)
+	}
+
+	out := httpMACResolverResponse{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("failed to parse response from %q: %v", u.String(), err)
+	}
+	if out.MAC == "" {
+		return "", fmt.Errorf("MAC resolver at %q returned an empty MAC", u.String())
+	}
+	return out.MAC, nil
+}
+
+// hashMACResolver derives a deterministic, locally-administered MAC from
+// sha256(containerID+network), so the same container+network always gets
+// the same address without needing any external state.
+type hashMACResolver struct{}
+
+func (hashMACResolver) ResolveMAC(containerID, network, rancherUUID string) (string, error) {
+	sum := sha256.Sum256([]byte(containerID + network))
+
+	mac := make([]byte, 6)
+	copy(mac, sum[:6])
+
+	// set the locally-administered bit and clear the multicast bit so the
+	// result is a valid unicast, locally-administered address
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]), nil
+}
+
+// staticPoolMACResolver hands out the first MAC from a fixed pool that
+// isn't already assigned to another attachment on the same network,
+// according to the on-disk attachment store.
+type staticPoolMACResolver struct {
+	pool []string
+}
+
+func (r staticPoolMACResolver) ResolveMAC(containerID, network, rancherUUID string) (string, error) {
+	used, err := usedMACsForNetwork(network)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine MACs already in use on network %q: %v", network, err)
+	}
+
+	for _, mac := range r.pool {
+		if !used[mac] {
+			return mac, nil
+		}
+	}
+	return "", fmt.Errorf("macPool exhausted for network %q", network)
+}
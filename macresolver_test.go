@@ -0,0 +1,119 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestHashMACResolverDeterministic(t *testing.T) {
+	r := hashMACResolver{}
+
+	mac1, err := r.ResolveMAC("container-a", "network-a", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mac2, err := r.ResolveMAC("container-a", "network-a", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mac1 != mac2 {
+		t.Fatalf("got different MACs for the same container+network: %q vs %q", mac1, mac2)
+	}
+
+	mac3, err := r.ResolveMAC("container-b", "network-a", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mac3 == mac1 {
+		t.Fatalf("expected a different MAC for a different container")
+	}
+}
+
+func TestHashMACResolverIsLocallyAdministeredUnicast(t *testing.T) {
+	mac, err := (hashMACResolver{}).ResolveMAC("container-a", "network-a", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatalf("ResolveMAC returned an unparseable MAC %q: %v", mac, err)
+	}
+	if hw[0]&0x02 == 0 {
+		t.Fatalf("MAC %q is not locally administered", mac)
+	}
+	if hw[0]&0x01 != 0 {
+		t.Fatalf("MAC %q is a multicast address", mac)
+	}
+}
+
+func TestFileMACResolver(t *testing.T) {
+	f, err := ioutil.TempFile("", "mac-assignments-*.json")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write([]byte(`{"container-a/network-a":"aa:bb:cc:dd:ee:ff"}`)); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %v", err)
+	}
+
+	r := fileMACResolver{path: f.Name()}
+
+	mac, err := r.ResolveMAC("container-a", "network-a", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mac != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("got %q, want %q", mac, "aa:bb:cc:dd:ee:ff")
+	}
+
+	if _, err := r.ResolveMAC("container-b", "network-a", ""); err == nil {
+		t.Fatal("expected an error for a container/network with no assignment")
+	}
+}
+
+func TestFileMACResolverMissingFile(t *testing.T) {
+	r := fileMACResolver{path: "/nonexistent/mac-assignments.json"}
+	if _, err := r.ResolveMAC("container-a", "network-a", ""); err == nil {
+		t.Fatal("expected an error when the assignments file doesn't exist")
+	}
+}
+
+func TestStaticPoolMACResolverReturnsFirstAvailable(t *testing.T) {
+	r := staticPoolMACResolver{pool: []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}}
+
+	mac, err := r.ResolveMAC("test-container", "macresolver-test-network-unused", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mac != "aa:bb:cc:dd:ee:01" {
+		t.Fatalf("got %q, want %q", mac, "aa:bb:cc:dd:ee:01")
+	}
+}
+
+func TestStaticPoolMACResolverExhausted(t *testing.T) {
+	r := staticPoolMACResolver{}
+	if _, err := r.ResolveMAC("test-container", "macresolver-test-network-unused", ""); err == nil {
+		t.Fatal("expected an error when the pool is empty")
+	}
+}
@@ -12,37 +12,80 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// This file holds the platform-neutral config parsing and types, so they
+// can be built and unit-tested without a Linux netns/netlink environment.
+// The actual interface creation/teardown lives in macvlan_linux.go, with
+// macvlan_windows.go/macvlan_unspecified.go providing stubs elsewhere.
+
 package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"net"
-	"os"
-	"runtime"
+	"strings"
 
-	"github.com/Sirupsen/logrus"
-	"github.com/containernetworking/cni/pkg/ip"
-	"github.com/containernetworking/cni/pkg/ipam"
-	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/utils/sysctl"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/vishvananda/netlink"
 )
 
-const (
-	IPv4InterfaceArpProxySysctlTemplate = "net.ipv4.conf.%s.proxy_arp"
-)
-
 type NetConf struct {
 	types.NetConf
-	Master      string `json:"master"`
-	Mode        string `json:"mode"`
-	MTU         int    `json:"mtu"`
-	IsDefaultGW bool   `json:"isDefaultGateway"`
+	Master        string              `json:"master"`
+	Mode          string              `json:"mode"`
+	MTU           int                 `json:"mtu"`
+	IsDefaultGW   bool                `json:"isDefaultGateway"`
+	Networks      []NetworkAttachment `json:"networks,omitempty"`
+	RuntimeConfig RuntimeConfig       `json:"runtimeConfig,omitempty"`
+
+	// MACSource selects the MACResolver implementation used when a
+	// container doesn't already have a MAC assigned: "rancher-metadata"
+	// (default), "file", "http", "static-pool", or "hash". See
+	// macresolver.go.
+	MACSource     string   `json:"macSource,omitempty"`
+	MACSourceFile string   `json:"macSourceFile,omitempty"`
+	MACSourceURL  string   `json:"macSourceURL,omitempty"`
+	MACPool       []string `json:"macPool,omitempty"`
+}
+
+// NetworkAttachment describes one macvlan interface this plugin should
+// create inside the container netns. Configs that only ever attached a
+// single network keep using the top-level Master/Mode/MTU/IsDefaultGW
+// fields; configs listing several networks in "networks" get one
+// NetworkAttachment each, with its own master/mode/ifName/IPAM.
+type NetworkAttachment struct {
+	Name        string     `json:"name"`
+	Master      string     `json:"master"`
+	Mode        string     `json:"mode"`
+	MTU         int        `json:"mtu"`
+	IfName      string     `json:"ifName"`
+	IsDefaultGW bool       `json:"isDefaultGateway"`
+	IPAM        types.IPAM `json:"ipam"`
+}
+
+// defaultNetworkName is used to key the on-disk attachment store for
+// configs that don't set "networks" and therefore only ever attach once.
+const defaultNetworkName = "default"
+
+// attachments returns the list of networks this invocation should attach
+// to the container. Single-network configs are normalized into a single
+// attachment so cmdAdd/cmdDel only ever have to deal with the list form.
+func attachments(n *NetConf, primaryIfName string) []NetworkAttachment {
+	if len(n.Networks) > 0 {
+		return n.Networks
+	}
+	return []NetworkAttachment{
+		{
+			Name:        defaultNetworkName,
+			Master:      n.Master,
+			Mode:        n.Mode,
+			MTU:         n.MTU,
+			IfName:      primaryIfName,
+			IsDefaultGW: n.IsDefaultGW,
+			IPAM:        n.IPAM,
+		},
+	}
 }
 
 // NetArgs holds the args passed to the network plugin
@@ -53,21 +96,40 @@ type NetArgs struct {
 	MACAddress           types.UnmarshallableString
 }
 
-func init() {
-	// this ensures that main runs only on main thread (thread group leader).
-	// since namespace ops (unshare, setns) are done for a single thread, we
-	// must ensure that the goroutine does not jump from OS thread to thread
-	runtime.LockOSThread()
-}
-
 func loadConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
-	if n.Master == "" {
+	if n.Master == "" && len(n.Networks) == 0 {
 		return nil, fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
+	seenNames := map[string]bool{}
+	for i, a := range n.Networks {
+		if a.Master == "" {
+			return nil, fmt.Errorf("networks[%d]: \"master\" field is required", i)
+		}
+		if a.IfName == "" {
+			return nil, fmt.Errorf("networks[%d]: \"ifName\" field is required", i)
+		}
+		// a.Name is used verbatim to build the on-disk attachment record
+		// path (see store.go's attachmentRecordPath), so it can't be
+		// allowed to contain path separators or ".." components.
+		if strings.ContainsAny(a.Name, `/\`) || strings.Contains(a.Name, "..") {
+			return nil, fmt.Errorf("networks[%d]: \"name\" %q must not contain path separators or \"..\"", i, a.Name)
+		}
+		// a.Name also keys the attachment record file (see store.go's
+		// attachmentRecordPath), so two attachments sharing a name - or
+		// both leaving it blank - would collide on the same record and
+		// silently reuse each other's persisted MAC address.
+		if a.Name == "" {
+			return nil, fmt.Errorf("networks[%d]: \"name\" field is required", i)
+		}
+		if seenNames[a.Name] {
+			return nil, fmt.Errorf("networks[%d]: \"name\" %q is already used by another entry", i, a.Name)
+		}
+		seenNames[a.Name] = true
+	}
 	return n, nil
 }
 
@@ -94,177 +156,6 @@ func modeFromString(s string) (netlink.MacvlanMode, error) {
 	}
 }
 
-func createMacvlan(conf *NetConf, ifName string, netns ns.NetNS) error {
-	mode, err := modeFromString(conf.Mode)
-	if err != nil {
-		return err
-	}
-
-	m, err := netlink.LinkByName(conf.Master)
-	if err != nil {
-		return fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
-	}
-
-	// due to kernel bug we have to create with tmpName or it might
-	// collide with the name on the host and error out
-	tmpName, err := ip.RandomVethName()
-	if err != nil {
-		return err
-	}
-
-	mv := &netlink.Macvlan{
-		LinkAttrs: netlink.LinkAttrs{
-			MTU:         conf.MTU,
-			Name:        tmpName,
-			ParentIndex: m.Attrs().Index,
-			Namespace:   netlink.NsFd(int(netns.Fd())),
-		},
-		Mode: mode,
-	}
-
-	if err := netlink.LinkAdd(mv); err != nil {
-		return fmt.Errorf("failed to create macvlan: %v", err)
-	}
-
-	return netns.Do(func(_ ns.NetNS) error {
-		// TODO: duplicate following lines for ipv6 support, when it will be added in other places
-		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
-		if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
-			// remove the newly added link and ignore errors, because we already are in a failed state
-			_ = netlink.LinkDel(mv)
-			return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
-		}
-
-		err := renameLink(tmpName, ifName)
-		if err != nil {
-			_ = netlink.LinkDel(mv)
-			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
-		}
-		return nil
-	})
-}
-
-func cmdAdd(args *skel.CmdArgs) error {
-	n, err := loadConf(args.StdinData)
-	if err != nil {
-		return err
-	}
-
-	nArgs, err := loadNetArgs(args.Args)
-	if err != nil {
-		return err
-	}
-
-	netns, err := ns.GetNS(args.Netns)
-	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
-	}
-	defer netns.Close()
-
-	if !checkIfContainerInterfaceExists(args) {
-		if err = createMacvlan(n, args.IfName, netns); err != nil {
-			return err
-		}
-	} else {
-		logrus.Infof("rancher-cni-macvlan: container already has interface: %v, no worries", args.IfName)
-		if err = setInterfaceDown(args); err != nil {
-			logrus.Infof("rancher-cni-macvlan: set interface %v down: %v", args.IfName, err)
-		}
-	}
-
-	// run the IPAM plugin and get back the config to apply
-	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
-	if err != nil {
-		return err
-	}
-	if result.IP4 == nil {
-		return errors.New("IPAM plugin returned missing IPv4 config")
-	}
-
-	macAddressToSet := ""
-	if nArgs.MACAddress != "" {
-		logrus.Infof("rancher-cni-macvlan: setting the %v interface %v MAC address: %v", args.ContainerID, args.IfName, nArgs.MACAddress)
-		macAddressToSet = string(nArgs.MACAddress)
-	} else {
-		macAddressToSet, err = findMACAddressForContainer(args.ContainerID, string(nArgs.RancherContainerUUID))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "rancher-cni-macvlan: err=%v", err)
-			return err
-		}
-		logrus.Infof("rancher-cni-macvlan: found the %v interface %v MAC address: %v", args.ContainerID, args.IfName, macAddressToSet)
-	}
-
-	err = netns.Do(func(_ ns.NetNS) error {
-		err := setInterfaceMacAddress(args.IfName, macAddressToSet)
-		if err != nil {
-			return fmt.Errorf("couldn't set the MAC Address of the interface: %v", err)
-		}
-		// set the default gateway if requested
-		if n.IsDefaultGW {
-			_, defaultNet, err := net.ParseCIDR("0.0.0.0/0")
-			if err != nil {
-				return err
-			}
-
-			for _, route := range result.IP4.Routes {
-				if defaultNet.String() == route.Dst.String() {
-					if route.GW != nil && !route.GW.Equal(result.IP4.Gateway) {
-						return fmt.Errorf(
-							"isDefaultGateway ineffective because IPAM sets default route via %q",
-							route.GW,
-						)
-					}
-				}
-			}
-
-			result.IP4.Routes = append(
-				result.IP4.Routes,
-				types.Route{Dst: *defaultNet, GW: result.IP4.Gateway},
-			)
-
-			// TODO: IPV6
-		}
-
-		return configureInterface(args.IfName, result)
-	})
-	if err != nil {
-		return err
-	}
-
-	result.DNS = n.DNS
-	return result.Print()
-
-}
-
-func cmdDel(args *skel.CmdArgs) error {
-	n, err := loadConf(args.StdinData)
-	if err != nil {
-		return err
-	}
-
-	err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
-	if err != nil {
-		return err
-	}
-
-	if args.Netns == "" {
-		return nil
-	}
-
-	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		return ip.DelLinkByName(args.IfName)
-	})
-}
-
-func renameLink(curName, newName string) error {
-	link, err := netlink.LinkByName(curName)
-	if err != nil {
-		return err
-	}
-
-	return netlink.LinkSetName(link, newName)
-}
-
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.Legacy)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "rancher-cni-macvlan")
 }
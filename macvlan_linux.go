@@ -0,0 +1,577 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	IPv4InterfaceArpProxySysctlTemplate = "net.ipv4.conf.%s.proxy_arp"
+	IPv6InterfaceProxyNdpSysctlTemplate = "net.ipv6.conf.%s.proxy_ndp"
+	IPv6InterfaceAcceptRaSysctlTemplate = "net.ipv6.conf.%s.accept_ra"
+)
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func createMacvlan(master, mode string, mtu int, ifName string, netns ns.NetNS) error {
+	macvlanMode, err := modeFromString(mode)
+	if err != nil {
+		return err
+	}
+
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	// due to kernel bug we have to create with tmpName or it might
+	// collide with the name on the host and error out
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return err
+	}
+
+	mv := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			MTU:         mtu,
+			Name:        tmpName,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: macvlanMode,
+	}
+
+	if err := netlink.LinkAdd(mv); err != nil {
+		return fmt.Errorf("failed to create macvlan: %v", err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
+		if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
+			// remove the newly added link and ignore errors, because we already are in a failed state
+			_ = netlink.LinkDel(mv)
+			return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
+		}
+
+		err := renameLink(tmpName, ifName)
+		if err != nil {
+			_ = netlink.LinkDel(mv)
+			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
+		}
+		return nil
+	})
+}
+
+// enableIPv6ProxyNdp turns on proxy_ndp for ifName and disables accept_ra,
+// mirroring the IPv4 proxy_arp setup above so dual-stack and v6-only
+// configs work the same way bridge-mode macvlan does for v4.
+func enableIPv6ProxyNdp(ifName string) error {
+	acceptRaSysctlValueName := fmt.Sprintf(IPv6InterfaceAcceptRaSysctlTemplate, ifName)
+	if _, err := sysctl.Sysctl(acceptRaSysctlValueName, "0"); err != nil {
+		return fmt.Errorf("failed to disable accept_ra on newly added interface %q: %v", ifName, err)
+	}
+
+	proxyNdpSysctlValueName := fmt.Sprintf(IPv6InterfaceProxyNdpSysctlTemplate, ifName)
+	if _, err := sysctl.Sysctl(proxyNdpSysctlValueName, "1"); err != nil {
+		return fmt.Errorf("failed to set proxy_ndp on newly added interface %q: %v", ifName, err)
+	}
+
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	nArgs, err := loadNetArgs(args.Args)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+	}
+	defer netns.Close()
+
+	atts := attachments(n, args.IfName)
+
+	// Each attachment gets its own macvlan device and IPAM run, so merge
+	// their per-attachment types100.Result objects into the one aggregate
+	// result this invocation reports back to the runtime.
+	aggregate := &types100.Result{CNIVersion: types100.ImplementedSpecVersion}
+
+	var primaryIP net.IP
+	for i, att := range atts {
+		attResult, err := addAttachment(args, n, nArgs, netns, att)
+		if err != nil {
+			return err
+		}
+
+		ifaceOffset := len(aggregate.Interfaces)
+		aggregate.Interfaces = append(aggregate.Interfaces, attResult.Interfaces...)
+		for _, ipc := range attResult.IPs {
+			if ipc.Interface != nil {
+				idx := ifaceOffset + *ipc.Interface
+				ipc.Interface = &idx
+			}
+			aggregate.IPs = append(aggregate.IPs, ipc)
+		}
+		aggregate.Routes = append(aggregate.Routes, attResult.Routes...)
+
+		if i == 0 {
+			primaryIP = primaryResultIP(attResult)
+		}
+	}
+
+	if len(n.RuntimeConfig.PortMaps) > 0 {
+		if primaryIP == nil {
+			return errors.New("runtimeConfig.portMappings requires an IPv4 address on the primary network")
+		}
+		if err := setupPortMapping(args.ContainerID, atts[0].Master, primaryIP, n.RuntimeConfig.PortMaps); err != nil {
+			return err
+		}
+	}
+
+	aggregate.DNS = n.DNS
+	return aggregate.Print()
+}
+
+// addAttachment creates (or reuses) the macvlan interface for a single
+// network attachment, runs its IPAM plugin, and configures the resulting
+// addresses. The IP and MAC it ends up using are persisted to the
+// attachment store so a later cmdAdd for the same container+network
+// (e.g. after a network reload) reuses the same MAC instead of resolving
+// a new one.
+func addAttachment(args *skel.CmdArgs, n *NetConf, nArgs *NetArgs, netns ns.NetNS, att NetworkAttachment) (*types100.Result, error) {
+	rec, err := loadAttachmentRecord(args.ContainerID, att.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !checkIfContainerInterfaceExists(args, att.IfName) {
+		if err := createMacvlan(att.Master, att.Mode, att.MTU, att.IfName, netns); err != nil {
+			return nil, err
+		}
+	} else {
+		logrus.Infof("rancher-cni-macvlan: container already has interface: %v, no worries", att.IfName)
+		if err := setInterfaceDown(args, att.IfName); err != nil {
+			logrus.Infof("rancher-cni-macvlan: set interface %v down: %v", att.IfName, err)
+		}
+	}
+
+	ipamConf, err := ipamStdinData(n, att)
+	if err != nil {
+		return nil, err
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	ipamRawResult, err := ipam.ExecAdd(att.IPAM.Type, ipamConf)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := types100.NewResultFromResult(ipamRawResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert IPAM result to the current CNI format: %v", err)
+	}
+	if len(result.IPs) == 0 {
+		return nil, errors.New("IPAM plugin returned missing IP config")
+	}
+
+	macAddressToSet := ""
+	switch {
+	case nArgs.MACAddress != "":
+		logrus.Infof("rancher-cni-macvlan: setting the %v interface %v MAC address: %v", args.ContainerID, att.IfName, nArgs.MACAddress)
+		macAddressToSet = string(nArgs.MACAddress)
+	case rec != nil && rec.MAC != "":
+		logrus.Infof("rancher-cni-macvlan: reusing persisted MAC address %v for %v interface %v on network %v", rec.MAC, args.ContainerID, att.IfName, att.Name)
+		macAddressToSet = rec.MAC
+	default:
+		resolver, err := macResolverFromConfig(n)
+		if err != nil {
+			return nil, err
+		}
+		macAddressToSet, err = resolver.ResolveMAC(args.ContainerID, att.Name, string(nArgs.RancherContainerUUID))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rancher-cni-macvlan: err=%v", err)
+			return nil, err
+		}
+		logrus.Infof("rancher-cni-macvlan: found the %v interface %v MAC address: %v", args.ContainerID, att.IfName, macAddressToSet)
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		err := setInterfaceMacAddress(att.IfName, macAddressToSet)
+		if err != nil {
+			return fmt.Errorf("couldn't set the MAC Address of the interface: %v", err)
+		}
+
+		if hasIPv6(result) {
+			if err := enableIPv6ProxyNdp(att.IfName); err != nil {
+				return err
+			}
+		}
+
+		// set the default gateway(s) if requested
+		if att.IsDefaultGW {
+			if err := addDefaultRoutes(result); err != nil {
+				return err
+			}
+		}
+
+		return configureInterface(att.IfName, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ifIndex := 0
+	result.Interfaces = []*types100.Interface{
+		{
+			Name:    att.IfName,
+			Mac:     macAddressToSet,
+			Sandbox: args.Netns,
+		},
+	}
+	for _, ipc := range result.IPs {
+		idx := ifIndex
+		ipc.Interface = &idx
+	}
+
+	if err := saveAttachmentRecord(args.ContainerID, att.Name, &attachmentRecord{
+		IfName: att.IfName,
+		Master: att.Master,
+		MAC:    macAddressToSet,
+		IP:     resultIPString(result),
+	}); err != nil {
+		logrus.Infof("rancher-cni-macvlan: failed to persist attachment record for %v on network %v: %v", args.ContainerID, att.Name, err)
+	}
+
+	return result, nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	for _, att := range attachments(n, args.IfName) {
+		if err := checkAttachment(args, netns, att); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAttachment verifies that the macvlan device recorded for
+// (containerID, network) still exists in the target netns with the
+// expected MAC, MTU, master and IP.
+func checkAttachment(args *skel.CmdArgs, netns ns.NetNS, att NetworkAttachment) error {
+	rec, err := loadAttachmentRecord(args.ContainerID, att.Name)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return fmt.Errorf("CHECK: no attachment record found for %s on network %s", args.ContainerID, att.Name)
+	}
+
+	master, err := netlink.LinkByName(att.Master)
+	if err != nil {
+		return fmt.Errorf("CHECK: failed to look up master %q: %v", att.Master, err)
+	}
+	masterIndex := master.Attrs().Index
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(att.IfName)
+		if err != nil {
+			return fmt.Errorf("CHECK: interface %q not found in netns %q: %v", att.IfName, args.Netns, err)
+		}
+
+		if _, ok := link.(*netlink.Macvlan); !ok {
+			return fmt.Errorf("CHECK: interface %q is not a macvlan device", att.IfName)
+		}
+
+		attrs := link.Attrs()
+		if att.MTU != 0 && attrs.MTU != att.MTU {
+			return fmt.Errorf("CHECK: interface %q has MTU %d, expected %d", att.IfName, attrs.MTU, att.MTU)
+		}
+
+		if rec.MAC != "" && attrs.HardwareAddr.String() != rec.MAC {
+			return fmt.Errorf("CHECK: interface %q has MAC %q, expected %q", att.IfName, attrs.HardwareAddr, rec.MAC)
+		}
+
+		if attrs.ParentIndex != masterIndex {
+			return fmt.Errorf("CHECK: interface %q has master index %d, expected %d (master %q)", att.IfName, attrs.ParentIndex, masterIndex, att.Master)
+		}
+
+		if rec.IP == "" {
+			return nil
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("CHECK: failed to list addresses on %q: %v", att.IfName, err)
+		}
+		for _, a := range addrs {
+			if a.IP.String() == rec.IP {
+				return nil
+			}
+		}
+		return fmt.Errorf("CHECK: interface %q is missing expected address %q", att.IfName, rec.IP)
+	})
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	atts := attachments(n, args.IfName)
+
+	if len(n.RuntimeConfig.PortMaps) > 0 {
+		if rec, err := loadAttachmentRecord(args.ContainerID, atts[0].Name); err == nil && rec != nil && rec.IP != "" {
+			if err := teardownPortMapping(args.ContainerID, net.ParseIP(rec.IP), n.RuntimeConfig.PortMaps); err != nil {
+				logrus.Infof("rancher-cni-macvlan: failed to remove port mappings for %v: %v", args.ContainerID, err)
+			}
+		}
+	}
+
+	// cmdDel must be best-effort: a failure tearing down one attachment
+	// shouldn't leave the others (and their IPAM allocations) leaked, so
+	// every attachment gets a teardown attempt and the errors are
+	// aggregated at the end.
+	var errs []string
+	for _, att := range atts {
+		if err := delAttachment(args, n, att); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete %d of %d attachments: %s", len(errs), len(atts), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func delAttachment(args *skel.CmdArgs, n *NetConf, att NetworkAttachment) error {
+	ipamConf, err := ipamStdinData(n, att)
+	if err != nil {
+		return err
+	}
+
+	if err := ipam.ExecDel(att.IPAM.Type, ipamConf); err != nil {
+		return err
+	}
+
+	if err := deleteAttachmentRecord(args.ContainerID, att.Name); err != nil {
+		logrus.Infof("rancher-cni-macvlan: failed to remove attachment record for %v on network %v: %v", args.ContainerID, att.Name, err)
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return ip.DelLinkByName(att.IfName)
+	})
+}
+
+// ipamStdinData builds the JSON a network attachment's IPAM plugin expects
+// on stdin: the top-level NetConf fields plus that attachment's own
+// "ipam" block, so each network in a multi-network config can use a
+// distinct IPAM plugin and subnet.
+func ipamStdinData(n *NetConf, att NetworkAttachment) ([]byte, error) {
+	conf := struct {
+		types.NetConf
+		IPAM types.IPAM `json:"ipam"`
+	}{
+		NetConf: n.NetConf,
+		IPAM:    att.IPAM,
+	}
+	return json.Marshal(conf)
+}
+
+// isIPv4 reports whether ipc holds an IPv4 address. types100.IPConfig has
+// no explicit Version field (unlike the old "current" result type it
+// replaces), so the family is inferred from the address itself.
+func isIPv4(ipc *types100.IPConfig) bool {
+	return ipc.Address.IP.To4() != nil
+}
+
+// resultIPString returns the primary IP recorded in an IPAM result, for
+// persistence in the attachment store. IPv4 wins when a result is
+// dual-stack. The recorded address is the one cmdCheck looks for on the
+// interface and the one cmdDel removes port mappings for.
+func resultIPString(result *types100.Result) string {
+	for _, ipc := range result.IPs {
+		if isIPv4(ipc) {
+			return ipc.Address.IP.String()
+		}
+	}
+	if len(result.IPs) > 0 {
+		return result.IPs[0].Address.IP.String()
+	}
+	return ""
+}
+
+func hasIPv6(result *types100.Result) bool {
+	for _, ipc := range result.IPs {
+		if !isIPv4(ipc) {
+			return true
+		}
+	}
+	return false
+}
+
+// addDefaultRoutes appends a default route for every IP family present in
+// result, failing if the IPAM plugin already set a conflicting default
+// route of its own.
+func addDefaultRoutes(result *types100.Result) error {
+	for _, ipc := range result.IPs {
+		cidr := "0.0.0.0/0"
+		if !isIPv4(ipc) {
+			cidr = "::/0"
+		}
+		if err := addDefaultRoute(cidr, ipc, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addDefaultRoute(cidr string, ipc *types100.IPConfig, result *types100.Result) error {
+	_, defaultNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range result.Routes {
+		if defaultNet.String() == route.Dst.String() {
+			if route.GW != nil && !route.GW.Equal(ipc.Gateway) {
+				return fmt.Errorf(
+					"isDefaultGateway ineffective because IPAM sets default route via %q",
+					route.GW,
+				)
+			}
+			return nil
+		}
+	}
+
+	result.Routes = append(result.Routes, &types.Route{Dst: *defaultNet, GW: ipc.Gateway})
+	return nil
+}
+
+func renameLink(curName, newName string) error {
+	link, err := netlink.LinkByName(curName)
+	if err != nil {
+		return err
+	}
+
+	return netlink.LinkSetName(link, newName)
+}
+
+// checkIfContainerInterfaceExists reports whether ifName already exists
+// inside the container netns, so addAttachment can skip creating a
+// macvlan device for an interface a previous cmdAdd already set up (e.g. a
+// retried ADD after a partial failure).
+func checkIfContainerInterfaceExists(args *skel.CmdArgs, ifName string) bool {
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return false
+	}
+	defer netns.Close()
+
+	exists := false
+	_ = netns.Do(func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(ifName)
+		exists = err == nil
+		return nil
+	})
+	return exists
+}
+
+// setInterfaceDown brings ifName down inside the container netns, so
+// a reused interface can be safely reconfigured (MAC, addresses) before
+// being brought back up as part of configureInterface.
+func setInterfaceDown(args *skel.CmdArgs, ifName string) error {
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to look up interface %q: %v", ifName, err)
+		}
+		return netlink.LinkSetDown(link)
+	})
+}
+
+// setInterfaceMacAddress sets ifName's hardware address. The caller is
+// expected to already be running inside the target netns (addAttachment
+// calls it from within netns.Do).
+func setInterfaceMacAddress(ifName, mac string) error {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %v", mac, err)
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to look up interface %q: %v", ifName, err)
+	}
+
+	return netlink.LinkSetHardwareAddr(link, hwAddr)
+}
+
+// configureInterface applies an IPAM result's addresses (and brings the
+// interface up) via the same helper the upstream CNI plugins use, so
+// macvlan attachments get identical address/route handling.
+func configureInterface(ifName string, result *types100.Result) error {
+	return ipam.ConfigureIface(ifName, result)
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestLoadConfRequiresMasterOrNetworks(t *testing.T) {
+	if _, err := loadConf([]byte(`{}`)); err == nil {
+		t.Fatal("expected an error when neither \"master\" nor \"networks\" is set")
+	}
+}
+
+func TestLoadConfSingleNetwork(t *testing.T) {
+	n, err := loadConf([]byte(`{"master":"eth0","mode":"bridge"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n.Master != "eth0" {
+		t.Fatalf("got master %q, want %q", n.Master, "eth0")
+	}
+}
+
+func TestLoadConfNetworksValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr string
+	}{
+		{
+			name:    "missing master",
+			conf:    `{"networks":[{"ifName":"eth1"}]}`,
+			wantErr: "master",
+		},
+		{
+			name:    "missing ifName",
+			conf:    `{"networks":[{"master":"eth0"}]}`,
+			wantErr: "ifName",
+		},
+		{
+			name:    "name with path separator",
+			conf:    `{"networks":[{"master":"eth0","ifName":"eth1","name":"../evil"}]}`,
+			wantErr: "name",
+		},
+		{
+			name:    "name with dotdot",
+			conf:    `{"networks":[{"master":"eth0","ifName":"eth1","name":"a..b"}]}`,
+			wantErr: "name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConf([]byte(tt.conf))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %q, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadNetArgs(t *testing.T) {
+	nArgs, err := loadNetArgs("MACAddress=aa:bb:cc:dd:ee:ff;RancherContainerUUID=abc123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(nArgs.MACAddress) != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("got MACAddress %q, want %q", nArgs.MACAddress, "aa:bb:cc:dd:ee:ff")
+	}
+	if string(nArgs.RancherContainerUUID) != "abc123" {
+		t.Fatalf("got RancherContainerUUID %q, want %q", nArgs.RancherContainerUUID, "abc123")
+	}
+}
+
+func TestLoadNetArgsEmpty(t *testing.T) {
+	nArgs, err := loadNetArgs("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nArgs.MACAddress != "" {
+		t.Fatalf("got MACAddress %q, want empty", nArgs.MACAddress)
+	}
+}
+
+func TestModeFromString(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    netlink.MacvlanMode
+		wantErr bool
+	}{
+		{"", netlink.MACVLAN_MODE_BRIDGE, false},
+		{"bridge", netlink.MACVLAN_MODE_BRIDGE, false},
+		{"private", netlink.MACVLAN_MODE_PRIVATE, false},
+		{"vepa", netlink.MACVLAN_MODE_VEPA, false},
+		{"passthru", netlink.MACVLAN_MODE_PASSTHRU, false},
+		{"bogus", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := modeFromString(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("modeFromString(%q): expected an error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("modeFromString(%q): unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("modeFromString(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentsDefaultsToSingleNetwork(t *testing.T) {
+	n := &NetConf{Master: "eth0", Mode: "bridge", MTU: 1500, IsDefaultGW: true}
+	atts := attachments(n, "eth0.1")
+	if len(atts) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(atts))
+	}
+	att := atts[0]
+	if att.Name != defaultNetworkName || att.Master != "eth0" || att.IfName != "eth0.1" || !att.IsDefaultGW {
+		t.Fatalf("unexpected attachment: %+v", att)
+	}
+}
+
+func TestAttachmentsMultiNetwork(t *testing.T) {
+	n := &NetConf{
+		Networks: []NetworkAttachment{
+			{Name: "net1", Master: "eth0", IfName: "eth1"},
+			{Name: "net2", Master: "eth1", IfName: "eth2"},
+		},
+	}
+	atts := attachments(n, "ignored")
+	if len(atts) != 2 {
+		t.Fatalf("got %d attachments, want 2", len(atts))
+	}
+	if atts[0].Name != "net1" || atts[1].Name != "net2" {
+		t.Fatalf("unexpected attachment order: %+v", atts)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+func cmdAdd(args *skel.CmdArgs) error {
+	return fmt.Errorf("rancher-cni-macvlan: macvlan is not supported on this platform")
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	return fmt.Errorf("rancher-cni-macvlan: macvlan is not supported on this platform")
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	return fmt.Errorf("rancher-cni-macvlan: macvlan is not supported on this platform")
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file holds the platform-neutral portMappings config types, so
+// NetConf can reference them on every platform. The iptables-based
+// implementation that actually programs the mappings is Linux-only and
+// lives in portmap_linux.go.
+
+package main
+
+// PortMapEntry is one hostPort->containerPort mapping requested via
+// runtimeConfig.portMappings, in the same shape the upstream portmap
+// meta-plugin accepts.
+type PortMapEntry struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// RuntimeConfig carries the portMappings a chained runtime (podman,
+// nerdctl, ...) fills in at add time. Macvlan children aren't reachable
+// from the host by default, so this plugin programs the DNAT itself
+// instead of requiring a separately chained portmap plugin.
+type RuntimeConfig struct {
+	PortMaps []PortMapEntry `json:"portMappings,omitempty"`
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	dnatChain      = "RANCHER-MACVLAN-DNAT"
+	dnatChainTable = "nat"
+)
+
+// setupPortMapping programs DNAT rules forwarding each configured host
+// port to containerIP on its macvlan child, plus the route_localnet +
+// MASQUERADE hairpin workaround so the host itself can reach a mapped
+// port on its own macvlan child.
+func setupPortMapping(containerID, master string, containerIP net.IP, entries []PortMapEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %v", err)
+	}
+
+	if err := ensureDNATChain(ipt); err != nil {
+		return err
+	}
+
+	if err := enableRouteLocalnet(master); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := ipt.AppendUnique(dnatChainTable, dnatChain, dnatRuleSpec(containerID, containerIP, e)...); err != nil {
+			return fmt.Errorf("failed to add DNAT rule for %s %d->%d: %v", e.Protocol, e.HostPort, e.ContainerPort, err)
+		}
+		if err := ipt.AppendUnique(dnatChainTable, "POSTROUTING", hairpinRuleSpec(containerID, containerIP, e)...); err != nil {
+			return fmt.Errorf("failed to add hairpin rule for %s %d->%d: %v", e.Protocol, e.HostPort, e.ContainerPort, err)
+		}
+	}
+
+	return nil
+}
+
+// teardownPortMapping removes the rules setupPortMapping added for this
+// container. Rule specs are rebuilt the same way they were created, since
+// iptables deletion requires an exact match.
+func teardownPortMapping(containerID string, containerIP net.IP, entries []PortMapEntry) error {
+	if len(entries) == 0 || containerIP == nil {
+		return nil
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %v", err)
+	}
+
+	for _, e := range entries {
+		if err := ipt.DeleteIfExists(dnatChainTable, dnatChain, dnatRuleSpec(containerID, containerIP, e)...); err != nil {
+			return fmt.Errorf("failed to remove DNAT rule for %s %d->%d: %v", e.Protocol, e.HostPort, e.ContainerPort, err)
+		}
+		if err := ipt.DeleteIfExists(dnatChainTable, "POSTROUTING", hairpinRuleSpec(containerID, containerIP, e)...); err != nil {
+			return fmt.Errorf("failed to remove hairpin rule for %s %d->%d: %v", e.Protocol, e.HostPort, e.ContainerPort, err)
+		}
+	}
+
+	return nil
+}
+
+// ensureDNATChain makes sure the RANCHER-MACVLAN-DNAT chain exists and is
+// jumped to from both PREROUTING (traffic arriving from outside) and
+// OUTPUT (traffic the host itself originates, e.g. curl localhost:<port>).
+func ensureDNATChain(ipt *iptables.IPTables) error {
+	exists, err := ipt.ChainExists(dnatChainTable, dnatChain)
+	if err != nil {
+		return fmt.Errorf("failed to check for %s chain: %v", dnatChain, err)
+	}
+	if !exists {
+		if err := ipt.NewChain(dnatChainTable, dnatChain); err != nil {
+			return fmt.Errorf("failed to create %s chain: %v", dnatChain, err)
+		}
+	}
+
+	for _, parent := range []string{"PREROUTING", "OUTPUT"} {
+		if err := ipt.AppendUnique(dnatChainTable, parent, "-j", dnatChain); err != nil {
+			return fmt.Errorf("failed to jump %s -> %s: %v", parent, dnatChain, err)
+		}
+	}
+
+	return nil
+}
+
+func dnatRuleSpec(containerID string, containerIP net.IP, e PortMapEntry) []string {
+	spec := []string{
+		"-p", e.Protocol,
+		"--dport", fmt.Sprintf("%d", e.HostPort),
+		"-m", "comment", "--comment", fmt.Sprintf("rancher-cni-macvlan dnat %s", containerID),
+		"-j", "DNAT",
+		"--to-destination", fmt.Sprintf("%s:%d", containerIP.String(), e.ContainerPort),
+	}
+	if e.HostIP != "" {
+		spec = append([]string{"-d", e.HostIP}, spec...)
+	}
+	return spec
+}
+
+func hairpinRuleSpec(containerID string, containerIP net.IP, e PortMapEntry) []string {
+	return []string{
+		"-s", "127.0.0.0/8",
+		"-p", e.Protocol,
+		"-d", containerIP.String(),
+		"--dport", fmt.Sprintf("%d", e.ContainerPort),
+		"-m", "comment", "--comment", fmt.Sprintf("rancher-cni-macvlan hairpin %s", containerID),
+		"-j", "MASQUERADE",
+	}
+}
+
+// enableRouteLocalnet lets the host treat 127.0.0.0/8 as routable out the
+// master interface, which combined with the POSTROUTING MASQUERADE rule
+// above lets the host reach a mapped port on its own macvlan child via
+// 127.0.0.1:<hostPort>.
+func enableRouteLocalnet(master string) error {
+	name := fmt.Sprintf("net.ipv4.conf.%s.route_localnet", master)
+	if _, err := sysctl.Sysctl(name, "1"); err != nil {
+		return fmt.Errorf("failed to enable route_localnet on %q: %v", master, err)
+	}
+	return nil
+}
+
+func primaryResultIP(result *types100.Result) net.IP {
+	if result == nil {
+		return nil
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil {
+			return ipc.Address.IP
+		}
+	}
+	return nil
+}
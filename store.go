@@ -0,0 +1,116 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// attachmentStoreDir holds one JSON file per (containerID, network) this
+// plugin has attached, so the IP and MAC it assigned survive a network
+// reload or container restore. cmdAdd reuses the recorded MAC instead of
+// resolving a new one; it does not reuse the recorded IP: the IPAM plugin
+// is run again and the address it returns is used and recorded.
+const attachmentStoreDir = "/var/lib/cni/rancher-macvlan"
+
+// attachmentRecord is what gets persisted for a single network attachment.
+type attachmentRecord struct {
+	IfName string `json:"ifName"`
+	Master string `json:"master"`
+	IP     string `json:"ip"`
+	MAC    string `json:"mac"`
+}
+
+func attachmentRecordPath(containerID, network string) string {
+	return filepath.Join(attachmentStoreDir, fmt.Sprintf("%s-%s.json", containerID, network))
+}
+
+// loadAttachmentRecord returns the persisted record for (containerID,
+// network), or nil if none has been saved yet.
+func loadAttachmentRecord(containerID, network string) (*attachmentRecord, error) {
+	data, err := ioutil.ReadFile(attachmentRecordPath(containerID, network))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment record for %s/%s: %v", containerID, network, err)
+	}
+
+	rec := &attachmentRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("failed to parse attachment record for %s/%s: %v", containerID, network, err)
+	}
+	return rec, nil
+}
+
+func saveAttachmentRecord(containerID, network string, rec *attachmentRecord) error {
+	if err := os.MkdirAll(attachmentStoreDir, 0700); err != nil {
+		return fmt.Errorf("failed to create attachment store dir %q: %v", attachmentStoreDir, err)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(attachmentRecordPath(containerID, network), data, 0600)
+}
+
+func deleteAttachmentRecord(containerID, network string) error {
+	err := os.Remove(attachmentRecordPath(containerID, network))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove attachment record for %s/%s: %v", containerID, network, err)
+	}
+	return nil
+}
+
+// usedMACsForNetwork scans the attachment store for every record on
+// network and returns the set of MACs already assigned there, so a
+// static-pool MACResolver can hand out one that isn't taken.
+func usedMACsForNetwork(network string) (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(attachmentStoreDir)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachment store dir %q: %v", attachmentStoreDir, err)
+	}
+
+	suffix := fmt.Sprintf("-%s.json", network)
+	used := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(attachmentStoreDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		rec := &attachmentRecord{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			continue
+		}
+		if rec.MAC != "" {
+			used[rec.MAC] = true
+		}
+	}
+	return used, nil
+}